@@ -6,23 +6,72 @@
 //
 //	go run ./scripts/e2e_hooks_cli.go --profile debug --build
 //	go run ./scripts/e2e_hooks_cli.go --profile release --build
+//	go run ./scripts/e2e_hooks_cli.go --profile debug --hook-transport http
+//	go run ./scripts/e2e_hooks_cli.go --cassette fixtures/hooks.jsonl
+//	go run ./scripts/e2e_hooks_cli.go --record-cassette fixtures/hooks.jsonl --upstream-api-key sk-...
 //
 // What it does:
-// - Builds (optional) and runs `codex exec ...` against a stub HTTP server.
-// - Writes a temporary CODEX_HOME/config.toml that points model requests to the stub server.
-// - Configures `[hooks]` to run a tiny script that records one JSON line per hook invocation.
-// - Asserts the expected hook events fire in order: turn_started → exec_command_begin → exec_command_end → turn_complete.
+//   - Self-checks the reusable responsesstub package's fingerprint-based replay (verifyCassetteReplay)
+//     before anything else runs, proving LoadCassette/SaveCassette/NewReplay dispatch by Fingerprint
+//     rather than by arrival order.
+//   - Builds (optional) and runs `codex exec ...` against a stub HTTP server backed by
+//     responsesstub. By default it replays hand-built, in-memory fixtures (order-fallback
+//     entries, since the scenario's SSE content bakes in per-run temp paths); --cassette instead
+//     replays a committed, fingerprint-matched cassette file, and --record-cassette proxies to a
+//     live Responses API endpoint (--upstream-base-url/--upstream-api-key) and writes what it sees
+//     to a new cassette via SaveCassette instead of running the rest of the scenario.
+//   - Writes a temporary CODEX_HOME/config.toml that points model requests to the stub server.
+//   - Configures `[hooks]` to fire via one of two transports (--hook-transport): the original
+//     exec script, or an in-process HTTP receiver exercising the webhook transport. Either way,
+//     hook invocations are delivered the structured JSON payload described by hookPayload.
+//   - Asserts the expected hook events fire in order: turn_started → exec_command_begin (x4) → turn_complete.
+//   - Asserts that a "deny" decision returned by a hook blocks that tool call, and that a second
+//     exec_command_begin hook entry scoped to a command_regex matching no queued command never
+//     fires, proving the matcher actually excludes calls rather than just being accepted syntax.
+//     Both assertions hold for whichever transport is under test.
+//   - Configures the exec_command_end hook with a short timeout_ms and makes it hang past that
+//     deadline, then asserts a "hook_timeout" notification appears in the turn's event stream,
+//     turn_complete still fires, and the whole run finishes well inside slowHookMaxElapsed
+//     instead of waiting out the hook's full hang.
+//   - Configures a second, fast exec_command_end entry scoped to one dedicated shell call, so
+//     at least one post-event hook invocation actually completes, then asserts its call record's
+//     stdin payload carries real tool_output/exit_status, and that turn_id/cwd/model round-trip
+//     correctly on every hook call of this run (not just that event).
+//   - Queues a shell command containing a fake secret and configures the exec_command_begin
+//     hook to return a "modify" decision rewriting the command and redacting the secret, then
+//     asserts the sandboxed process only ever sees the rewritten command, and that the secret
+//     never appears unredacted on codex's --json event stream.
+//   - Queues a second shell command containing a different fake secret and configures the hook
+//     to return a "modify" decision that redacts the secret without rewriting tool_input, then
+//     asserts the original, unmodified command actually ran (redaction alone doesn't change
+//     execution) while the secret still never appears unredacted on the --json event stream.
+//   - Sets a fake secret on an environment variable and queues a shell command that echoes it,
+//     configuring the hook to return a "modify" decision that repeats the command verbatim but
+//     overrides that var in tool_input.env, then asserts the command still ran (its output file
+//     was created) but saw the scrubbed value, never the original.
+//   - Configures a second, always-failing hook entry on turn_started (on_error = "warn") and
+//     asserts a "hook_error" notification appears for it, the turn continues regardless, and it
+//     never writes a success call record.
+//   - Configures a third, always-failing hook entry on exec_command_begin (on_error =
+//     "abort_turn"), scoped to one dedicated, last-queued shell call, then asserts a
+//     "hook_error" notification appears for it, codex exec itself exits non-zero, the dedicated
+//     call's own side effect never happens, and turn_complete never fires — proving abort_turn
+//     actually stops the turn instead of merely echoing back its configured policy.
 package main
 
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -31,6 +80,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/openai/codex/scripts/testsupport/responsesstub"
 )
 
 type profile string
@@ -40,63 +91,226 @@ const (
 	profileRelease profile = "release"
 )
 
-type stubServer struct {
-	mu           sync.Mutex
-	sseQueue     []string
-	responseReqs []map[string]any
+// hookTransport selects how the harness configures `[hooks]` to fire: spawning the exec
+// script (the original transport) or POSTing to an in-process HTTP receiver. Both
+// transports must produce the same hook_call records in callsDir so the rest of the
+// assertions in main can run unchanged regardless of which one is under test.
+type hookTransport string
+
+const (
+	hookTransportExec hookTransport = "exec"
+	hookTransportHTTP hookTransport = "http"
+)
+
+// hookHMACSecretEnv is the env var name the codex process would read the HMAC signing
+// secret from for the http transport; config.toml references it by name rather than by
+// value so the secret never appears in the written config file.
+const hookHMACSecretEnv = "CODEX_E2E_HOOK_HMAC_SECRET"
+
+const hookHMACSecretValue = "e2e-test-hmac-secret"
+
+const hookSignatureHeader = "X-Codex-Hook-Signature-256"
+
+// The exec_command_end hook in this harness is deliberately made to hang well past its
+// timeout_ms, so the test can assert codex cancels it (SIGTERM, then SIGKILL if it doesn't
+// exit) rather than stalling the turn. slowHookMaxElapsed bounds the whole `codex exec` run:
+// it must hold well under slowHookHang, proving the deadline was enforced and not just logged.
+const (
+	slowHookEvent      = "exec_command_end"
+	slowHookTimeoutMs  = 300
+	slowHookHang       = 3 * time.Second
+	slowHookMaxElapsed = 2 * time.Second
+)
+
+// hookTimeoutEvent is a notification codex emits on its --json event stream when a hook
+// invocation is cancelled for exceeding its deadline.
+type hookTimeoutEvent struct {
+	Type         string `json:"type"`
+	Event        string `json:"event"`
+	SubmissionID string `json:"submission_id"`
 }
 
-func (s *stubServer) popSSE() (string, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if len(s.sseQueue) == 0 {
-		return "", false
+func findHookTimeoutEvents(stdout string) []hookTimeoutEvent {
+	var out []hookTimeoutEvent
+	for _, line := range strings.Split(stdout, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] != '{' {
+			continue
+		}
+		var ev hookTimeoutEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			continue
+		}
+		if ev.Type == "hook_timeout" {
+			out = append(out, ev)
+		}
 	}
-	body := s.sseQueue[0]
-	s.sseQueue = s.sseQueue[1:]
-	return body, true
+	return out
 }
 
-func (s *stubServer) recordResponseRequest(body map[string]any) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.responseReqs = append(s.responseReqs, body)
+// hookErrorEvent is a notification codex emits on its --json event stream when a hook
+// invocation fails (non-2xx webhook response, or a non-zero exec script exit), carrying the
+// on_error policy that was resolved for it (the entry's override, or the [hooks] default).
+type hookErrorEvent struct {
+	Type         string      `json:"type"`
+	Event        string      `json:"event"`
+	SubmissionID string      `json:"submission_id"`
+	OnError      hookOnError `json:"on_error"`
 }
 
-func (s *stubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch {
-	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/models"):
-		w.Header().Set("content-type", "application/json")
-		_, _ = io.WriteString(w, `{"models":[]}`)
-		return
-	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/responses"):
-		raw, _ := io.ReadAll(r.Body)
-		_ = r.Body.Close()
-		var parsed map[string]any
-		_ = json.Unmarshal(raw, &parsed)
-		if len(parsed) != 0 {
-			s.recordResponseRequest(parsed)
+func findHookErrorEvents(stdout string) []hookErrorEvent {
+	var out []hookErrorEvent
+	for _, line := range strings.Split(stdout, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] != '{' {
+			continue
+		}
+		var ev hookErrorEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			continue
+		}
+		if ev.Type == "hook_error" {
+			out = append(out, ev)
 		}
+	}
+	return out
+}
 
-		body, ok := s.popSSE()
-		if !ok {
-			http.Error(w, "no queued SSE responses", http.StatusInternalServerError)
-			return
+// execCommandBeginEvent mirrors the exec_command_begin entry on codex's --json event stream.
+// Once a hook's "modify" decision has been applied, the rewrite and any redact spans must
+// already be reflected here: Command must never contain a secret a hook asked to have
+// redacted, even though the hook itself necessarily saw it in hookPayload.ToolInput.
+type execCommandBeginEvent struct {
+	Type    string `json:"type"`
+	Event   string `json:"event"`
+	Command string `json:"command"`
+}
+
+func findExecCommandBeginEvents(stdout string) []execCommandBeginEvent {
+	var out []execCommandBeginEvent
+	for _, line := range strings.Split(stdout, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] != '{' {
+			continue
 		}
-		w.Header().Set("content-type", "text/event-stream")
-		_, _ = io.WriteString(w, body)
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
+		var ev execCommandBeginEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			continue
+		}
+		if ev.Type == "exec_command_begin" {
+			out = append(out, ev)
 		}
-		return
-	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/responses/compact"):
-		// Not expected for this test, but return a harmless response if core requests it.
-		w.Header().Set("content-type", "application/json")
-		_, _ = io.WriteString(w, `{"summary":"ok"}`)
-		return
-	default:
-		http.NotFound(w, r)
 	}
+	return out
+}
+
+// assertSecretNotLeaked checks that no exec_command_begin event on the --json stream contains
+// secret verbatim, and that at least one contains placeholder in its place instead. Used for
+// both the rewrite+redact scenario (fakeSecretValue) and the redact-only scenario
+// (redactOnlyMarker), which must mask the same way even though only the former also rewrites
+// the command that actually runs.
+func assertSecretNotLeaked(events []execCommandBeginEvent, secret, placeholder string) error {
+	sawPlaceholder := false
+	for _, ev := range events {
+		if strings.Contains(ev.Command, secret) {
+			return fmt.Errorf("--json event stream leaked the unredacted secret in an exec_command_begin event: %q", ev.Command)
+		}
+		if strings.Contains(ev.Command, placeholder) {
+			sawPlaceholder = true
+		}
+	}
+	if !sawPlaceholder {
+		return fmt.Errorf("expected an exec_command_begin event on the --json stream reporting the redacted command (placeholder %q)", placeholder)
+	}
+	return nil
+}
+
+// hookPayloadSchemaVersion is bumped whenever the shape of hookPayload changes in a
+// backwards-incompatible way. Hook authors can branch on it instead of guessing fields.
+const hookPayloadSchemaVersion = 1
+
+// hookPayload is the structured JSON document Codex writes to a hook process's stdin.
+// It replaces the older CODEX_HOOK_* environment-variable-only contract; CODEX_HOOK_SEQ
+// and CODEX_HOOK_EVENT remain as lightweight argv/env bookkeeping so a hook script can
+// name its output file without parsing JSON, but everything about the turn and the tool
+// call lives here.
+type hookPayload struct {
+	SchemaVersion int    `json:"schema_version"`
+	Event         string `json:"event"`
+	SubmissionID  string `json:"submission_id"`
+	TurnID        string `json:"turn_id"`
+	Cwd           string `json:"cwd"`
+	Model         string `json:"model"`
+
+	// Populated for tool-related events (exec_command_begin/end, function_call, ...).
+	ToolName  string          `json:"tool_name,omitempty"`
+	ToolInput json.RawMessage `json:"tool_input,omitempty"`
+
+	// Populated for *_end events only.
+	ToolOutput *string `json:"tool_output,omitempty"`
+	ExitStatus *int    `json:"exit_status,omitempty"`
+}
+
+// hookDecision is what a hook may print to its stdout to influence the turn. Absent any
+// output (or output that doesn't parse), the default decision is "allow". For a "modify"
+// decision, ToolInput (when set) replaces the tool input codex dispatches verbatim — e.g. a
+// pre-exec hook rewriting a shell command's args or timeout_ms — and Redact (when set) lists
+// literal spans that must be masked wherever the call is subsequently logged or transcribed,
+// regardless of whether ToolInput was also rewritten.
+//
+// The real hook contract also defines "inject" (adding user-visible context to the turn
+// without altering the tool call itself), but no scenario in this harness drives it yet, so
+// it's left out of the documented/implemented set here until it has coverage.
+type hookDecision struct {
+	Decision  string          `json:"decision"` // "allow" (default), "deny", or "modify"
+	Message   string          `json:"message,omitempty"`
+	ToolInput json.RawMessage `json:"tool_input,omitempty"`
+	Redact    []string        `json:"redact,omitempty"`
+}
+
+// hookMatcher restricts a hook entry to a subset of tool calls. A zero-value matcher
+// matches everything for that event.
+type hookMatcher struct {
+	ToolNames    []string `json:"tool_names,omitempty"`
+	CommandRegex string   `json:"command_regex,omitempty"`
+}
+
+// hookOnError selects what a failed hook invocation (non-2xx webhook response, or a non-zero
+// exec script exit) does to the turn: "ignore" drops it silently, "warn" surfaces a hook_error
+// notification but lets the turn continue, and "abort_turn" fails the turn. It can be set as a
+// [hooks] default or overridden per entry.
+type hookOnError string
+
+const (
+	hookOnErrorIgnore    hookOnError = "ignore"
+	hookOnErrorWarn      hookOnError = "warn"
+	hookOnErrorAbortTurn hookOnError = "abort_turn"
+)
+
+// hookEntryOptionsFields renders m's matcher fields plus optional timeout_ms/on_error overrides
+// as comma-separated `key = value` TOML fragments, for splicing into a hook entry's inline
+// options table in hooks.toml (timeoutMs/onErr are omitted when zero/empty). Returns "" if m is
+// the zero value and neither override is given, so callers can tell whether an options table is
+// needed at all.
+func hookEntryOptionsFields(m hookMatcher, timeoutMs int, onErr hookOnError) string {
+	var parts []string
+	if len(m.ToolNames) > 0 {
+		names := make([]string, len(m.ToolNames))
+		for i, n := range m.ToolNames {
+			names[i] = strconv.Quote(n)
+		}
+		parts = append(parts, fmt.Sprintf("tool_names = [%s]", strings.Join(names, ", ")))
+	}
+	if m.CommandRegex != "" {
+		parts = append(parts, fmt.Sprintf("command_regex = %q", m.CommandRegex))
+	}
+	if timeoutMs > 0 {
+		parts = append(parts, fmt.Sprintf("timeout_ms = %d", timeoutMs))
+	}
+	if onErr != "" {
+		parts = append(parts, fmt.Sprintf("on_error = %q", onErr))
+	}
+	return strings.Join(parts, ", ")
 }
 
 func sse(events ...map[string]any) string {
@@ -170,19 +384,226 @@ func writeExecutable(path, content string) error {
 }
 
 type hookCall struct {
-	Seq          int
-	SeqStr       string
-	Expected     string
-	Event        string
-	SubmissionID string
-	Path         string
+	Seq           int
+	SeqStr        string
+	Expected      string
+	Event         string
+	SubmissionID  string
+	TurnID        string
+	Cwd           string
+	Model         string
+	ToolName      string
+	CommandLine   string
+	ToolOutput    *string
+	ExitStatus    *int
+	Denied        bool
+	SchemaVersion int
+	Path          string
 }
 
 type hookCallJSON struct {
-	Seq          string `json:"seq"`
-	Expected     string `json:"expected"`
-	Event        string `json:"event"`
-	SubmissionID string `json:"submission_id"`
+	Seq      string      `json:"seq"`
+	Expected string      `json:"expected"`
+	Denied   bool        `json:"denied"`
+	Payload  hookPayload `json:"payload"`
+}
+
+// newHookHTTPReceiver builds an in-process HTTP server standing in for a user's webhook
+// endpoint. It verifies the HMAC-SHA256 signature codex would send, then writes a record
+// into callsDir in exactly the format hook.sh uses so readHookCallsOnce/listHookCalls and
+// the rest of main's assertions are shared across both transports. The path segment after
+// "/hooks/" is taken as the event name (mirroring how the exec transport is told its
+// expected event via argv). An exec_command_begin command containing secretMarker gets a
+// "modify" decision rewriting it to redactedCommand and redacting secretMarker; one containing
+// redactOnlyMarker gets a "modify" decision that redacts redactOnlyMarker without touching
+// tool_input, so the original command still runs unmodified — exercising both the
+// rewrite+redact and the redact-only paths hook.sh's equivalent branches exercise. One
+// containing envScrubVarName gets a "modify" decision whose tool_input repeats the command
+// verbatim but overrides that var in an env map, scrubbing it without touching the command —
+// exercising env-scrubbing independently of command rewriting. Only the entry labeled
+// slowHookEvent itself hangs past slowHookHang; every other entry, including the
+// execCommandEndFastLabel one scoped to roundTripMarker, answers immediately.
+func newHookHTTPReceiver(callsDir, secret, denyMarker, secretMarker, redactedCommand, redactOnlyMarker, envScrubVarName, envScrubScrubbedValue string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hooks/", func(w http.ResponseWriter, r *http.Request) {
+		raw, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			http.Error(w, "read body", http.StatusBadRequest)
+			return
+		}
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(raw)
+		want := hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(r.Header.Get(hookSignatureHeader)), []byte(want)) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+
+		var payload hookPayload
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			http.Error(w, "bad payload", http.StatusBadRequest)
+			return
+		}
+
+		expected := strings.TrimPrefix(r.URL.Path, "/hooks/")
+
+		if strings.HasSuffix(expected, "_always_errors") {
+			// Simulates a broken webhook endpoint, without writing a call record, so the
+			// harness can assert the configured on_error policy's effect on the turn.
+			http.Error(w, "simulated hook failure", http.StatusInternalServerError)
+			return
+		}
+
+		if expected == slowHookEvent {
+			// Only the entry labeled slowHookEvent itself hangs; the execCommandEndFastLabel
+			// entry fires on the same real event but must complete immediately so at least one
+			// post-event hook invocation writes a call record with real tool_output/exit_status.
+			select {
+			case <-time.After(slowHookHang):
+			case <-r.Context().Done():
+				// A real client (codex) would cancel the request once timeout_ms elapses;
+				// there's nothing useful left to do once that happens.
+				return
+			}
+		}
+
+		seq := r.Header.Get("X-Codex-Hook-Seq")
+
+		denied := false
+		decision := hookDecision{Decision: "allow"}
+		if payload.Event == "exec_command_begin" {
+			var toolInput struct {
+				Command string `json:"command"`
+			}
+			_ = json.Unmarshal(payload.ToolInput, &toolInput)
+			switch {
+			case strings.Contains(toolInput.Command, denyMarker):
+				denied = true
+				decision = hookDecision{Decision: "deny", Message: "blocked by hook matcher"}
+			case strings.Contains(toolInput.Command, secretMarker):
+				rewritten, _ := json.Marshal(map[string]any{
+					"command":    redactedCommand,
+					"timeout_ms": 1000,
+				})
+				decision = hookDecision{Decision: "modify", ToolInput: rewritten, Redact: []string{secretMarker}}
+			case strings.Contains(toolInput.Command, redactOnlyMarker):
+				decision = hookDecision{Decision: "modify", Redact: []string{redactOnlyMarker}}
+			case strings.Contains(toolInput.Command, envScrubVarName):
+				rewritten, _ := json.Marshal(map[string]any{
+					"command":    toolInput.Command,
+					"timeout_ms": 1000,
+					"env":        map[string]string{envScrubVarName: envScrubScrubbedValue},
+				})
+				decision = hookDecision{Decision: "modify", ToolInput: rewritten}
+			}
+		}
+
+		record := hookCallJSON{Seq: seq, Expected: expected, Denied: denied, Payload: payload}
+		b, err := json.Marshal(record)
+		if err != nil {
+			http.Error(w, "marshal record", http.StatusInternalServerError)
+			return
+		}
+		tmp := filepath.Join(callsDir, seq+".json.tmp")
+		if err := os.WriteFile(tmp, b, 0o644); err != nil {
+			http.Error(w, "write record", http.StatusInternalServerError)
+			return
+		}
+		if err := os.Rename(tmp, filepath.Join(callsDir, seq+".json")); err != nil {
+			http.Error(w, "rename record", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(decision)
+	})
+	return &http.Server{Handler: mux}
+}
+
+// otlpStatusCodeOK is the OTLP Status.Code value for a span that completed without error; see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto.
+const otlpStatusCodeOK = 1
+
+// otlpSpan is the handful of fields this harness cares about from an OTLP JSON span: see
+// https://github.com/open-telemetry/opentelemetry-proto for the full ExportTraceServiceRequest
+// shape. attrs() flattens the OTLP {key, value: {stringValue|intValue|...}} attribute list into
+// a plain map for assertions.
+type otlpSpan struct {
+	TraceID      string              `json:"traceId"`
+	SpanID       string              `json:"spanId"`
+	ParentSpanID string              `json:"parentSpanId"`
+	Name         string              `json:"name"`
+	Attributes   []map[string]any    `json:"attributes"`
+	Status       *struct{ Code int } `json:"status"`
+}
+
+func (s otlpSpan) attrs() map[string]string {
+	out := make(map[string]string, len(s.Attributes))
+	for _, a := range s.Attributes {
+		key, _ := a["key"].(string)
+		value, _ := a["value"].(map[string]any)
+		for _, v := range value {
+			out[key] = fmt.Sprintf("%v", v)
+		}
+	}
+	return out
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []otlpSpan `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// otlpReceiver is a minimal in-process stand-in for an OTLP/HTTP trace collector, accepting
+// the JSON encoding of ExportTraceServiceRequest at POST /v1/traces.
+type otlpReceiver struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func newOTLPReceiver() *otlpReceiver {
+	return &otlpReceiver{}
+}
+
+func (o *otlpReceiver) Spans() []otlpSpan {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := make([]otlpSpan, len(o.spans))
+	copy(out, o.spans)
+	return out
+}
+
+func (o *otlpReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasSuffix(r.URL.Path, "/v1/traces") {
+		http.NotFound(w, r)
+		return
+	}
+	raw, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		http.Error(w, "read body", http.StatusBadRequest)
+		return
+	}
+	var req otlpExportRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		http.Error(w, "bad export request", http.StatusBadRequest)
+		return
+	}
+	o.mu.Lock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			o.spans = append(o.spans, ss.Spans...)
+		}
+	}
+	o.mu.Unlock()
+
+	w.Header().Set("content-type", "application/json")
+	_, _ = io.WriteString(w, `{}`)
 }
 
 func readHookCallsOnce(dir string) ([]hookCall, error) {
@@ -210,13 +631,30 @@ func readHookCallsOnce(dir string) ([]hookCall, error) {
 		if err := json.Unmarshal(b, &parsed); err != nil {
 			return nil, fmt.Errorf("parse hook record %s: %w", path, err)
 		}
+		commandLine := ""
+		if len(parsed.Payload.ToolInput) != 0 {
+			var toolInput struct {
+				Command string `json:"command"`
+			}
+			_ = json.Unmarshal(parsed.Payload.ToolInput, &toolInput)
+			commandLine = toolInput.Command
+		}
 		calls = append(calls, hookCall{
-			Seq:          seq,
-			SeqStr:       parsed.Seq,
-			Expected:     parsed.Expected,
-			Event:        parsed.Event,
-			SubmissionID: parsed.SubmissionID,
-			Path:         path,
+			Seq:           seq,
+			SeqStr:        parsed.Seq,
+			Expected:      parsed.Expected,
+			Event:         parsed.Payload.Event,
+			SubmissionID:  parsed.Payload.SubmissionID,
+			TurnID:        parsed.Payload.TurnID,
+			Cwd:           parsed.Payload.Cwd,
+			Model:         parsed.Payload.Model,
+			ToolName:      parsed.Payload.ToolName,
+			CommandLine:   commandLine,
+			ToolOutput:    parsed.Payload.ToolOutput,
+			ExitStatus:    parsed.Payload.ExitStatus,
+			Denied:        parsed.Denied,
+			SchemaVersion: parsed.Payload.SchemaVersion,
+			Path:          path,
 		})
 	}
 	sort.Slice(calls, func(i, j int) bool { return calls[i].Seq < calls[j].Seq })
@@ -252,6 +690,71 @@ func listHookCalls(dir string, wantAtLeast int, timeout time.Duration) ([]hookCa
 	}
 }
 
+// verifyCassetteReplay proves, independently of whether a real codex binary is available,
+// that responsesstub dispatches replay entries by Fingerprint rather than cassette order: it
+// saves a two-entry cassette, reloads it, and serves two requests in the opposite order from
+// how the entries were recorded, asserting each gets the SSE body matching its own fingerprint.
+func verifyCassetteReplay(scratchDir string) error {
+	cassettePath := filepath.Join(scratchDir, "verify_cassette.jsonl")
+	entries := []responsesstub.Entry{
+		{
+			Fingerprint: responsesstub.Fingerprint("gpt-5.1-codex", "second recorded, first replayed"),
+			SSE:         sse(evResponseCreated("resp-second"), evCompleted("resp-second")),
+		},
+		{
+			Fingerprint: responsesstub.Fingerprint("gpt-5.1-codex", "first recorded, second replayed"),
+			SSE:         sse(evResponseCreated("resp-first"), evCompleted("resp-first")),
+		},
+	}
+	if err := responsesstub.SaveCassette(cassettePath, entries); err != nil {
+		return fmt.Errorf("save cassette: %w", err)
+	}
+	loaded, err := responsesstub.LoadCassette(cassettePath)
+	if err != nil {
+		return fmt.Errorf("load cassette: %w", err)
+	}
+
+	srv := httptest.NewServer(responsesstub.NewReplay(loaded))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		input    string
+		wantResp string
+	}{
+		{"first recorded, second replayed", "resp-first"},
+		{"second recorded, first replayed", "resp-second"},
+	} {
+		body, err := postResponses(srv.URL, "gpt-5.1-codex", tc.input)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(body, tc.wantResp) {
+			return fmt.Errorf("fingerprint-matched replay for input %q returned %q, want it to contain %q", tc.input, body, tc.wantResp)
+		}
+	}
+	return nil
+}
+
+func postResponses(baseURL, model string, input any) (string, error) {
+	reqBody, err := json.Marshal(map[string]any{"model": model, "input": input})
+	if err != nil {
+		return "", fmt.Errorf("marshal request: %w", err)
+	}
+	resp, err := http.Post(baseURL+"/v1/responses", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return "", fmt.Errorf("post /v1/responses: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("read /v1/responses body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("post /v1/responses: status %d: %s", resp.StatusCode, body)
+	}
+	return string(body), nil
+}
+
 func cargoBuildCodex(codexRSDir string, prof profile) error {
 	args := []string{"build", "-p", "codex-cli"}
 	if prof == profileRelease {
@@ -272,6 +775,12 @@ func main() {
 		codexBin  = flag.String("codex-bin", "", "Path to codex binary (overrides --codex-repo/--profile)")
 		keepTmp   = flag.Bool("keep-tmp", false, "Keep temporary directories on success")
 		timeout   = flag.Duration("timeout", 2*time.Minute, "Overall timeout")
+		transport = flag.String("hook-transport", string(hookTransportExec), "Hook transport to exercise: exec or http")
+
+		cassette       = flag.String("cassette", "", "Replay a cassette file (see responsesstub.SaveCassette) instead of the built-in in-memory fixtures")
+		recordCassette = flag.String("record-cassette", "", "Record a new cassette to this path by proxying to --upstream-base-url, instead of running the e2e scenario")
+		upstreamBase   = flag.String("upstream-base-url", "https://api.openai.com/v1", "Upstream Responses API base URL for --record-cassette")
+		upstreamAPIKey = flag.String("upstream-api-key", "", "API key for --record-cassette (falls back to $OPENAI_API_KEY)")
 	)
 	flag.Parse()
 
@@ -281,6 +790,12 @@ func main() {
 		os.Exit(2)
 	}
 
+	transportVal := hookTransport(*transport)
+	if transportVal != hookTransportExec && transportVal != hookTransportHTTP {
+		fmt.Fprintf(os.Stderr, "invalid --hook-transport %q (expected exec or http)\n", *transport)
+		os.Exit(2)
+	}
+
 	codexRSDir := filepath.Join(*codexRepo, "codex-rs")
 	if abs, err := filepath.Abs(codexRSDir); err == nil {
 		codexRSDir = abs
@@ -321,6 +836,11 @@ func main() {
 		fmt.Fprintf(os.Stderr, "keeping tmp dir: %s\n", tmp)
 	}
 
+	if err := verifyCassetteReplay(tmp); err != nil {
+		fmt.Fprintf(os.Stderr, "cassette replay self-check failed: %v\n", err)
+		os.Exit(1)
+	}
+
 	codexHome := filepath.Join(tmp, "codex_home")
 	workspace := filepath.Join(tmp, "workspace")
 	hookDir := filepath.Join(tmp, "hooks")
@@ -338,43 +858,289 @@ func main() {
 		os.Exit(1)
 	}
 
+	// denyMarker is a substring the hook script looks for in the tool's command line.
+	// Any exec_command_begin whose command contains it is denied, which is enough to
+	// exercise the deny-decision and matcher-filtering paths without a real JSON
+	// parser in the hook script.
+	const denyMarker = "DENY_ME_MARKER"
+
+	// neverMatchingCommandRegex scopes a second, otherwise-identical exec_command_begin hook
+	// entry (labeled regexScopedHookLabel) so it can never match any command this harness
+	// queues; asserting no call record for that label ever appears in callsDir is the negative
+	// case proving a command_regex matcher actually excludes calls, not just accepts the config.
+	const neverMatchingCommandRegex = "NO_COMMAND_EVER_CONTAINS_THIS_STRING_xyz123"
+	const regexScopedHookLabel = "exec_command_begin_regex_scoped"
+
+	// fakeSecretValue stands in for a credential a model might echo into a shell command.
+	// Any exec_command_begin whose command contains it gets a "modify" decision rewriting
+	// the command to redactedCommand and redacting fakeSecretValue, exercising the
+	// rewrite/redaction path without a real JSON parser in the hook script.
+	const fakeSecretValue = "sk-FAKE-1234567890ABCDEF"
+	const redactedPlaceholder = "[redacted]"
+	secretFile := filepath.Join(workspace, "secret_redacted.txt")
+	redactedCommand := fmt.Sprintf("echo %s > %s", redactedPlaceholder, secretFile)
+	rewriteDecisionJSON, err := json.Marshal(map[string]any{
+		"decision": "modify",
+		"tool_input": map[string]any{
+			"command":    redactedCommand,
+			"timeout_ms": 1000,
+		},
+		"redact": []string{fakeSecretValue},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "marshal rewrite decision: %v\n", err)
+		os.Exit(1)
+	}
+
+	// turnStartedAlwaysErrorsLabel names a second hook entry on turn_started that always fails
+	// (non-zero exec exit, or a 500 webhook response) with on_error = "warn", so the harness can
+	// assert that policy's effect: the turn continues past the failure.
+	const turnStartedAlwaysErrorsLabel = "turn_started_always_errors"
+
+	// abortTurnMarker scopes a second, always-failing exec_command_begin hook entry (labeled
+	// execCommandBeginAlwaysErrorsLabel) with on_error = "abort_turn" to one dedicated shell
+	// call, queued last. Unlike turnStartedAlwaysErrorsLabel's "warn", aborting the turn here has
+	// an observable, checkable consequence: the matching call's own command never runs and
+	// turn_complete never fires, proving abort_turn actually stops the turn rather than just
+	// echoing its own policy back on a hook_error notification.
+	const abortTurnMarker = "ABORT_TURN_TRIGGER_MARKER"
+	const execCommandBeginAlwaysErrorsLabel = "exec_command_begin_always_errors"
+	abortTurnFile := filepath.Join(workspace, "abort_turn_should_not_run.txt")
+	abortTurnArgs, err := json.Marshal(map[string]any{
+		"command":    fmt.Sprintf("echo %s > %s", abortTurnMarker, abortTurnFile),
+		"timeout_ms": 1000,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "marshal abort-turn args: %v\n", err)
+		os.Exit(1)
+	}
+
+	// roundTripMarker scopes a fast, non-hanging exec_command_end hook entry (labeled
+	// execCommandEndFastLabel) to a single dedicated shell call, so at least one post-event hook
+	// invocation actually completes and writes a call record carrying real tool_output/exit_status
+	// — every other exec_command_end invocation in this run is the slow hook deliberately hung
+	// and cancelled by the timeout scenario below, and never gets that far.
+	const roundTripMarker = "HOOK_PAYLOAD_ROUNDTRIP_MARKER"
+	const execCommandEndFastLabel = "exec_command_end_fast"
+	roundTripArgs, err := json.Marshal(map[string]any{
+		"command":    fmt.Sprintf("printf %s", shellQuote(roundTripMarker)),
+		"timeout_ms": 1000,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "marshal round-trip args: %v\n", err)
+		os.Exit(1)
+	}
+
+	// redactOnlyMarker stands in for a second credential whose hook decision redacts it from
+	// logs/transcripts without rewriting tool_input at all, proving redaction and command
+	// rewriting are independent: the real, unmodified command must still run.
+	const redactOnlyMarker = "sk-FAKE-ANOTHER00000000"
+	redactOnlyFile := filepath.Join(workspace, "secret_redact_only.txt")
+	redactOnlyDecisionJSON, err := json.Marshal(map[string]any{
+		"decision": "modify",
+		"redact":   []string{redactOnlyMarker},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "marshal redact-only decision: %v\n", err)
+		os.Exit(1)
+	}
+
+	// envScrubVarName names an environment variable set on codex's own process (standing in
+	// for one a real user's shell might export) that carries a fake secret value. Any
+	// exec_command_begin whose command references it by name gets a "modify" decision whose
+	// tool_input repeats the same command verbatim — the "rewrite" is a no-op on the command
+	// itself — but overrides the var in a tool_input.env map, exercising env-scrubbing
+	// independently of command rewriting, the same way redactOnlyMarker exercises redaction
+	// independently of it.
+	const envScrubVarName = "ENV_SCRUB_SECRET_VAR"
+	const envScrubOriginalValue = "sk-FAKE-ENVSCRUB00000000"
+	const envScrubScrubbedValue = "[env-scrubbed]"
+	envScrubFile := filepath.Join(workspace, "env_scrub_output.txt")
+	envScrubCommand := fmt.Sprintf("printf '%%s' \"$%s\" > %s", envScrubVarName, shellQuote(envScrubFile))
+	envScrubDecisionJSON, err := json.Marshal(map[string]any{
+		"decision": "modify",
+		"tool_input": map[string]any{
+			"command":    envScrubCommand,
+			"timeout_ms": 1000,
+			"env":        map[string]string{envScrubVarName: envScrubScrubbedValue},
+		},
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "marshal env-scrub decision: %v\n", err)
+		os.Exit(1)
+	}
+
 	hookScript := filepath.Join(hookDir, "hook.sh")
-	if err := writeExecutable(hookScript, fmt.Sprintf(`#!/bin/sh
+	var hooksToml string
+	var hookSrv *http.Server
+	var hookLn net.Listener
+
+	switch transportVal {
+	case hookTransportExec:
+		if err := writeExecutable(hookScript, fmt.Sprintf(`#!/bin/sh
 set -eu
 out_dir=%q
 mkdir -p "$out_dir"
 expected="${1:-unset}"
 seq="${CODEX_HOOK_SEQ:-unset}"
 event="${CODEX_HOOK_EVENT:-unset}"
-submission_id="${CODEX_HOOK_SUBMISSION_ID:-unset}"
+payload="$(cat)"
+case "$expected" in
+  *_always_errors) exit 1 ;;
+esac
+if [ "$expected" = %q ]; then
+  sleep %d
+fi
+denied=false
+if [ "$event" = "exec_command_begin" ] && printf '%%s' "$payload" | grep -q %q; then
+  denied=true
+  printf '{"decision":"deny","message":"blocked by hook matcher"}\n'
+elif [ "$event" = "exec_command_begin" ] && printf '%%s' "$payload" | grep -qF %q; then
+  printf '%%s\n' %q
+elif [ "$event" = "exec_command_begin" ] && printf '%%s' "$payload" | grep -qF %q; then
+  printf '%%s\n' %q
+elif [ "$event" = "exec_command_begin" ] && printf '%%s' "$payload" | grep -qF %q; then
+  printf '%%s\n' %q
+fi
 tmp="$out_dir/$seq.json.tmp.$$"
-printf '{"seq":"%%s","expected":"%%s","event":"%%s","submission_id":"%%s"}\n' "$seq" "$expected" "$event" "$submission_id" > "$tmp"
+printf '{"seq":"%%s","expected":"%%s","denied":%%s,"payload":%%s}\n' "$seq" "$expected" "$denied" "$payload" > "$tmp"
 mv "$tmp" "$out_dir/$seq.json"
-`, callsDir)); err != nil {
-		fmt.Fprintf(os.Stderr, "write hook script: %v\n", err)
-		os.Exit(1)
+`, callsDir, slowHookEvent, int(slowHookHang.Seconds()), denyMarker, fakeSecretValue, string(rewriteDecisionJSON), redactOnlyMarker, string(redactOnlyDecisionJSON), envScrubVarName, string(envScrubDecisionJSON))); err != nil {
+			fmt.Fprintf(os.Stderr, "write hook script: %v\n", err)
+			os.Exit(1)
+		}
+		shellMatcherFields := hookEntryOptionsFields(hookMatcher{ToolNames: []string{"shell_command"}}, 0, "")
+		regexMatcherFields := hookEntryOptionsFields(hookMatcher{CommandRegex: neverMatchingCommandRegex}, 0, "")
+		abortMatcherFields := hookEntryOptionsFields(hookMatcher{CommandRegex: abortTurnMarker}, 0, hookOnErrorAbortTurn)
+		execEndFields := hookEntryOptionsFields(hookMatcher{}, slowHookTimeoutMs, "")
+		execEndFastFields := hookEntryOptionsFields(hookMatcher{CommandRegex: roundTripMarker}, 0, "")
+		warnOnErrorFields := hookEntryOptionsFields(hookMatcher{}, 0, hookOnErrorWarn)
+		hooksToml = fmt.Sprintf(`
+[hooks]
+default_timeout_ms = 5000
+default_on_error = %q
+
+turn_started = [[%q, "turn_started"], [%q, %q, { %s }]]
+exec_command_begin = [[%q, "exec_command_begin", { %s }], [%q, %q, { %s }], [%q, %q, { %s }]]
+exec_command_end = [[%q, "exec_command_end", { %s }], [%q, %q, { %s }]]
+turn_complete = [[%q, "turn_complete"]]
+`,
+			hookOnErrorIgnore,
+			hookScript, hookScript, turnStartedAlwaysErrorsLabel, warnOnErrorFields,
+			hookScript, shellMatcherFields, hookScript, regexScopedHookLabel, regexMatcherFields, hookScript, execCommandBeginAlwaysErrorsLabel, abortMatcherFields,
+			hookScript, execEndFields, hookScript, execCommandEndFastLabel, execEndFastFields,
+			hookScript,
+		)
+
+	case hookTransportHTTP:
+		var err error
+		hookLn, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "listen (hook receiver): %v\n", err)
+			os.Exit(1)
+		}
+		hookSrv = newHookHTTPReceiver(callsDir, hookHMACSecretValue, denyMarker, fakeSecretValue, redactedCommand, redactOnlyMarker, envScrubVarName, envScrubScrubbedValue)
+		go func() {
+			_ = hookSrv.Serve(hookLn)
+		}()
+		hookBaseURL := fmt.Sprintf("http://%s/hooks", hookLn.Addr().String())
+		shellMatcherFields := hookEntryOptionsFields(hookMatcher{ToolNames: []string{"shell_command"}}, 0, "")
+		regexMatcherFields := hookEntryOptionsFields(hookMatcher{CommandRegex: neverMatchingCommandRegex}, 0, "")
+		abortMatcherFields := hookEntryOptionsFields(hookMatcher{CommandRegex: abortTurnMarker}, 0, hookOnErrorAbortTurn)
+		execEndFastFields := hookEntryOptionsFields(hookMatcher{CommandRegex: roundTripMarker}, 0, "")
+		warnOnErrorFields := hookEntryOptionsFields(hookMatcher{}, 0, hookOnErrorWarn)
+		hooksToml = fmt.Sprintf(`
+[hooks]
+default_timeout_ms = 5000
+default_on_error = %q
+
+turn_started = [{ url = %q, timeout_ms = 2000, hmac_secret_env = %q }, { url = %q, timeout_ms = 2000, hmac_secret_env = %q, %s }]
+exec_command_begin = [{ url = %q, timeout_ms = 2000, hmac_secret_env = %q, %s }, { url = %q, timeout_ms = 2000, hmac_secret_env = %q, %s }, { url = %q, timeout_ms = 2000, hmac_secret_env = %q, %s }]
+exec_command_end = [{ url = %q, timeout_ms = %d, hmac_secret_env = %q }, { url = %q, timeout_ms = 2000, hmac_secret_env = %q, %s }]
+turn_complete = [{ url = %q, timeout_ms = 2000, hmac_secret_env = %q }]
+`,
+			hookOnErrorIgnore,
+			hookBaseURL+"/turn_started", hookHMACSecretEnv,
+			hookBaseURL+"/"+turnStartedAlwaysErrorsLabel, hookHMACSecretEnv, warnOnErrorFields,
+			hookBaseURL+"/exec_command_begin", hookHMACSecretEnv, shellMatcherFields,
+			hookBaseURL+"/"+regexScopedHookLabel, hookHMACSecretEnv, regexMatcherFields,
+			hookBaseURL+"/"+execCommandBeginAlwaysErrorsLabel, hookHMACSecretEnv, abortMatcherFields,
+			hookBaseURL+"/exec_command_end", slowHookTimeoutMs, hookHMACSecretEnv,
+			hookBaseURL+"/"+execCommandEndFastLabel, hookHMACSecretEnv, execEndFastFields,
+			hookBaseURL+"/turn_complete", hookHMACSecretEnv,
+		)
+	}
+	if hookLn != nil {
+		defer hookLn.Close()
+	}
+	if hookSrv != nil {
+		defer func() {
+			_ = hookSrv.Shutdown(context.Background())
+		}()
 	}
 
-	// Stub server (Responses API)
+	// Stub server (Responses API), replaying hand-built fixtures in queue order via
+	// the reusable responsesstub package (see scripts/testsupport/responsesstub).
 	targetFile := filepath.Join(workspace, "shell_ran.txt")
-	toolArgs, _ := json.Marshal(map[string]any{
+	deniedFile := filepath.Join(workspace, "denied.txt")
+	allowedArgs, _ := json.Marshal(map[string]any{
 		"command":    fmt.Sprintf("echo hook-ok > %s", shellQuote(targetFile)),
 		"timeout_ms": 1000,
 	})
+	deniedArgs, _ := json.Marshal(map[string]any{
+		"command":    fmt.Sprintf("echo %s > %s", denyMarker, shellQuote(deniedFile)),
+		"timeout_ms": 1000,
+	})
+	secretArgs, _ := json.Marshal(map[string]any{
+		"command":    fmt.Sprintf("echo %s > %s", fakeSecretValue, secretFile),
+		"timeout_ms": 1000,
+	})
+	redactOnlyArgs, _ := json.Marshal(map[string]any{
+		"command":    fmt.Sprintf("echo %s > %s", redactOnlyMarker, redactOnlyFile),
+		"timeout_ms": 1000,
+	})
+	envScrubArgs, _ := json.Marshal(map[string]any{
+		"command":    envScrubCommand,
+		"timeout_ms": 1000,
+	})
 
-	stub := &stubServer{
-		sseQueue: []string{
-			sse(
+	var stub *responsesstub.Stub
+	switch {
+	case *recordCassette != "":
+		apiKey := *upstreamAPIKey
+		if apiKey == "" {
+			apiKey = os.Getenv("OPENAI_API_KEY")
+		}
+		stub = responsesstub.NewRecord(*upstreamBase, apiKey)
+	case *cassette != "":
+		entries, err := responsesstub.LoadCassette(*cassette)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "load cassette %s: %v\n", *cassette, err)
+			os.Exit(1)
+		}
+		stub = responsesstub.NewReplay(entries)
+	default:
+		// The scenario's second request embeds the first tool calls' results, including
+		// per-run temp paths, so it can't be fingerprinted against a static cassette; these
+		// stay order-fallback entries (see verifyCassetteReplay for the fingerprinted path).
+		stub = responsesstub.NewReplay([]responsesstub.Entry{
+			{SSE: sse(
 				evResponseCreated("resp-1"),
-				evFunctionCallDone("call-1", "shell_command", string(toolArgs)),
+				evFunctionCallDone("call-1", "shell_command", string(allowedArgs)),
+				evFunctionCallDone("call-2", "shell_command", string(deniedArgs)),
+				evFunctionCallDone("call-3", "shell_command", string(secretArgs)),
+				evFunctionCallDone("call-4", "shell_command", string(redactOnlyArgs)),
+				evFunctionCallDone("call-5", "shell_command", string(roundTripArgs)),
+				evFunctionCallDone("call-6", "shell_command", string(envScrubArgs)),
+				evFunctionCallDone("call-7", "shell_command", string(abortTurnArgs)),
 				evCompleted("resp-1"),
-			),
-			sse(
+			)},
+			{SSE: sse(
 				evResponseCreated("resp-2"),
 				evAssistantMessageDone("msg-1", "done"),
 				evCompleted("resp-2"),
-			),
-		},
+			)},
+		})
 	}
 
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -393,7 +1159,29 @@ mv "$tmp" "$out_dir/$seq.json"
 		_ = srv.Shutdown(context.Background())
 	}()
 
-	// Codex config that points provider requests at our stub server and enables hooks.
+	// In-process OTLP/HTTP trace receiver, so the run's span tree can be asserted the same
+	// way the hook calls are: by inspecting what actually got reported, not by trusting config.
+	otlpRecv := newOTLPReceiver()
+	otlpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen (otlp): %v\n", err)
+		os.Exit(1)
+	}
+	defer otlpLn.Close()
+	otlpSrv := &http.Server{Handler: otlpRecv}
+	go func() {
+		_ = otlpSrv.Serve(otlpLn)
+	}()
+	defer func() {
+		_ = otlpSrv.Shutdown(context.Background())
+	}()
+	otlpEndpoint := fmt.Sprintf("http://%s/v1/traces", otlpLn.Addr().String())
+
+	// Codex config that points provider requests at our stub server and enables hooks via
+	// whichever transport is under test (see hooksToml above). exec_command_begin carries
+	// a matcher so the deny logic above only ever sees shell commands, mirroring how a real
+	// hook author would scope a policy hook to one tool. [telemetry] points OTLP/HTTP export
+	// at the in-process receiver above.
 	configToml := fmt.Sprintf(`
 model = "gpt-5.1-codex"
 model_provider = "stub"
@@ -416,12 +1204,12 @@ request_max_retries = 0
 stream_max_retries = 0
 stream_idle_timeout_ms = 30000
 
-[hooks]
-turn_started = [[%q, "turn_started"]]
-exec_command_begin = [[%q, "exec_command_begin"]]
-exec_command_end = [[%q, "exec_command_end"]]
-turn_complete = [[%q, "turn_complete"]]
-`, baseURL, hookScript, hookScript, hookScript, hookScript)
+[telemetry]
+endpoint = %q
+sampler = "always_on"
+"service.name" = "codex-e2e-hooks"
+headers = {}
+%s`, baseURL, otlpEndpoint, hooksToml)
 
 	if err := os.WriteFile(filepath.Join(codexHome, "config.toml"), []byte(configToml), 0o644); err != nil {
 		fmt.Fprintf(os.Stderr, "write config.toml: %v\n", err)
@@ -441,19 +1229,77 @@ turn_complete = [[%q, "turn_complete"]]
 	cmd.Env = filteredEnv(append(os.Environ(),
 		"CODEX_HOME="+codexHome,
 		"OPENAI_API_KEY=dummy",
+		hookHMACSecretEnv+"="+hookHMACSecretValue,
+		envScrubVarName+"="+envScrubOriginalValue,
 	))
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	if err := cmd.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "codex exec failed: %v\n", err)
-		if out := strings.TrimSpace(stdout.String()); out != "" {
-			fmt.Fprintf(os.Stderr, "\nstdout:\n%s\n", out)
+	runStart := time.Now()
+	runErr := cmd.Run()
+	if *recordCassette != "" {
+		if runErr != nil {
+			fmt.Fprintf(os.Stderr, "codex exec failed: %v\n", runErr)
+			if out := strings.TrimSpace(stdout.String()); out != "" {
+				fmt.Fprintf(os.Stderr, "\nstdout:\n%s\n", out)
+			}
+			if out := strings.TrimSpace(stderr.String()); out != "" {
+				fmt.Fprintf(os.Stderr, "\nstderr:\n%s\n", out)
+			}
+			os.Exit(1)
+		}
+		if err := responsesstub.SaveCassette(*recordCassette, stub.Recorded()); err != nil {
+			fmt.Fprintf(os.Stderr, "save cassette %s: %v\n", *recordCassette, err)
+			os.Exit(1)
+		}
+		fmt.Printf("recorded %d cassette entries to %s\n", len(stub.Recorded()), *recordCassette)
+		return
+	}
+	// The execCommandBeginAlwaysErrorsLabel hook (on_error = "abort_turn") is expected to fail
+	// the turn, so codex exec itself reporting a non-zero exit here is the scenario working as
+	// intended, not a harness bug — anything it got wrong about *how* still surfaces below via
+	// the stdout/hook-call assertions, which a genuine abort must still satisfy.
+	if runErr == nil {
+		fmt.Fprintf(os.Stderr, "codex exec succeeded, but expected it to fail once the %s hook triggers on_error=abort_turn\n", execCommandBeginAlwaysErrorsLabel)
+		os.Exit(1)
+	}
+
+	runElapsed := time.Since(runStart)
+	if runElapsed > slowHookMaxElapsed {
+		fmt.Fprintf(os.Stderr, "codex exec took %s, want under %s: the %s hook's timeout_ms=%dms was not enforced\n",
+			runElapsed, slowHookMaxElapsed, slowHookEvent, slowHookTimeoutMs)
+		os.Exit(1)
+	}
+
+	timeouts := findHookTimeoutEvents(stdout.String())
+	sawSlowHookTimeout := false
+	for _, ev := range timeouts {
+		if ev.Event == slowHookEvent {
+			sawSlowHookTimeout = true
 		}
-		if out := strings.TrimSpace(stderr.String()); out != "" {
-			fmt.Fprintf(os.Stderr, "\nstderr:\n%s\n", out)
+	}
+	if !sawSlowHookTimeout {
+		fmt.Fprintf(os.Stderr, "expected a hook_timeout event for %s in the --json stream, got %d unrelated timeout(s)\n", slowHookEvent, len(timeouts))
+		os.Exit(1)
+	}
+
+	hookErrors := findHookErrorEvents(stdout.String())
+	var sawWarnOnTurnStarted, sawAbortOnExecCommandBegin bool
+	for _, ev := range hookErrors {
+		switch {
+		case ev.Event == "turn_started" && ev.OnError == hookOnErrorWarn:
+			sawWarnOnTurnStarted = true
+		case ev.Event == "exec_command_begin" && ev.OnError == hookOnErrorAbortTurn:
+			sawAbortOnExecCommandBegin = true
 		}
+	}
+	if !sawWarnOnTurnStarted {
+		fmt.Fprintf(os.Stderr, "expected a hook_error event for the failing %s hook with on_error=%q (turn should continue)\n", turnStartedAlwaysErrorsLabel, hookOnErrorWarn)
+		os.Exit(1)
+	}
+	if !sawAbortOnExecCommandBegin {
+		fmt.Fprintf(os.Stderr, "expected a hook_error event for the failing %s hook with on_error=%q (turn should abort)\n", execCommandBeginAlwaysErrorsLabel, hookOnErrorAbortTurn)
 		os.Exit(1)
 	}
 
@@ -461,23 +1307,139 @@ turn_complete = [[%q, "turn_complete"]]
 		fmt.Fprintf(os.Stderr, "expected shell command to create %s: %v\n", targetFile, err)
 		os.Exit(1)
 	}
+	if _, err := os.Stat(deniedFile); err == nil {
+		fmt.Fprintf(os.Stderr, "expected denied shell command NOT to create %s\n", deniedFile)
+		os.Exit(1)
+	}
+	if _, err := os.Stat(abortTurnFile); err == nil {
+		fmt.Fprintf(os.Stderr, "expected the %s hook's abort_turn to prevent %s from running (file should not exist)\n", execCommandBeginAlwaysErrorsLabel, abortTurnFile)
+		os.Exit(1)
+	}
 
-	calls, err := listHookCalls(callsDir, 4, 5*time.Second)
+	secretFileContents, err := os.ReadFile(secretFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "expected hook-rewritten shell command to create %s: %v\n", secretFile, err)
+		os.Exit(1)
+	}
+	if strings.Contains(string(secretFileContents), fakeSecretValue) {
+		fmt.Fprintf(os.Stderr, "sandbox ran the model's original command instead of the hook's rewrite: %q\n", secretFileContents)
+		os.Exit(1)
+	}
+	if !strings.Contains(string(secretFileContents), redactedPlaceholder) {
+		fmt.Fprintf(os.Stderr, "expected %s to contain the hook's rewritten command output %q, got %q\n", secretFile, redactedPlaceholder, secretFileContents)
+		os.Exit(1)
+	}
+
+	redactOnlyFileContents, err := os.ReadFile(redactOnlyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "expected redact-only shell command to create %s: %v\n", redactOnlyFile, err)
+		os.Exit(1)
+	}
+	if !strings.Contains(string(redactOnlyFileContents), redactOnlyMarker) {
+		fmt.Fprintf(os.Stderr, "expected %s to contain the model's original (unrewritten) command output %q, got %q: a redact-only decision must not change what actually runs\n", redactOnlyFile, redactOnlyMarker, redactOnlyFileContents)
+		os.Exit(1)
+	}
+
+	envScrubFileContents, err := os.ReadFile(envScrubFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "expected env-scrub shell command to create %s: %v\n", envScrubFile, err)
+		os.Exit(1)
+	}
+	if strings.Contains(string(envScrubFileContents), envScrubOriginalValue) {
+		fmt.Fprintf(os.Stderr, "sandbox ran the command with its original, unscrubbed %s value: %q\n", envScrubVarName, envScrubFileContents)
+		os.Exit(1)
+	}
+	if !strings.Contains(string(envScrubFileContents), envScrubScrubbedValue) {
+		fmt.Fprintf(os.Stderr, "expected %s to contain the hook's scrubbed %s value %q, got %q: the command itself must still run unchanged, only its env scrubbed\n", envScrubFile, envScrubVarName, envScrubScrubbedValue, envScrubFileContents)
+		os.Exit(1)
+	}
+
+	execBeginEvents := findExecCommandBeginEvents(stdout.String())
+	if err := assertSecretNotLeaked(execBeginEvents, fakeSecretValue, redactedPlaceholder); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if err := assertSecretNotLeaked(execBeginEvents, redactOnlyMarker, redactedPlaceholder); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	calls, err := listHookCalls(callsDir, 9, 5*time.Second)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "hooks did not fire as expected: %v\n", err)
 		os.Exit(1)
 	}
-	want := []string{"turn_started", "exec_command_begin", "exec_command_end", "turn_complete"}
+	// The slowHookEvent-labeled exec_command_end entry is cancelled for exceeding its
+	// timeout_ms on every exec_command_end it matches, so it never gets to write its own call
+	// record (its outcome is asserted above via the hook_timeout event instead); only the
+	// execCommandEndFastLabel entry, scoped to roundTripMarker, completes and writes one.
+	// turn_complete never fires at all: the execCommandBeginAlwaysErrorsLabel hook on the last
+	// queued call aborts the turn before the turn can reach it. The base exec_command_begin
+	// hook still fires (and writes a record) for all 7 queued calls, including that last one,
+	// since it's a separate, unscoped entry from the one that aborts the turn.
+	want := []string{
+		"turn_started",
+		"exec_command_begin", "exec_command_begin", "exec_command_begin", "exec_command_begin", "exec_command_begin", "exec_command_begin",
+		"exec_command_end",
+		"exec_command_begin",
+	}
 	got := make([]string, 0, len(calls))
 	for _, c := range calls {
 		if c.SeqStr != "" && c.SeqStr != strconv.Itoa(c.Seq) {
 			fmt.Fprintf(os.Stderr, "hook record seq mismatch: file seq=%d json seq=%q (%s)\n", c.Seq, c.SeqStr, c.Path)
 			os.Exit(1)
 		}
-		if c.Expected != c.Event {
+		if c.Expected != c.Event && c.Expected != execCommandEndFastLabel {
 			fmt.Fprintf(os.Stderr, "hook record expected/event mismatch: expected=%q event=%q seq=%d (%s)\n", c.Expected, c.Event, c.Seq, c.Path)
 			os.Exit(1)
 		}
+		if c.Event != "" && c.SubmissionID == "" {
+			fmt.Fprintf(os.Stderr, "hook record %s missing submission_id from stdin payload\n", c.Path)
+			os.Exit(1)
+		}
+		if c.Event != "" && c.SchemaVersion != hookPayloadSchemaVersion {
+			fmt.Fprintf(os.Stderr, "hook record %s schema_version=%d, want %d\n", c.Path, c.SchemaVersion, hookPayloadSchemaVersion)
+			os.Exit(1)
+		}
+		if c.Event != "" {
+			if c.TurnID == "" {
+				fmt.Fprintf(os.Stderr, "hook record %s missing turn_id from stdin payload\n", c.Path)
+				os.Exit(1)
+			}
+			if c.Cwd != workspace {
+				fmt.Fprintf(os.Stderr, "hook record %s cwd=%q, want %q\n", c.Path, c.Cwd, workspace)
+				os.Exit(1)
+			}
+			if c.Model != "gpt-5.1-codex" {
+				fmt.Fprintf(os.Stderr, "hook record %s model=%q, want %q\n", c.Path, c.Model, "gpt-5.1-codex")
+				os.Exit(1)
+			}
+		}
+		if c.Expected == execCommandEndFastLabel {
+			if c.ToolOutput == nil || !strings.Contains(*c.ToolOutput, roundTripMarker) {
+				fmt.Fprintf(os.Stderr, "hook record %s tool_output=%v, want it to contain %q\n", c.Path, c.ToolOutput, roundTripMarker)
+				os.Exit(1)
+			}
+			if c.ExitStatus == nil || *c.ExitStatus != 0 {
+				fmt.Fprintf(os.Stderr, "hook record %s exit_status=%v, want 0\n", c.Path, c.ExitStatus)
+				os.Exit(1)
+			}
+		}
+		if c.Expected == regexScopedHookLabel {
+			fmt.Fprintf(os.Stderr, "hook entry %s, scoped to a command_regex matching no queued command, fired anyway (seq=%d, command=%q)\n", regexScopedHookLabel, c.Seq, c.CommandLine)
+			os.Exit(1)
+		}
+		if c.Expected == turnStartedAlwaysErrorsLabel || c.Expected == execCommandBeginAlwaysErrorsLabel {
+			fmt.Fprintf(os.Stderr, "hook entry %s, which always fails, wrote a success call record anyway (seq=%d)\n", c.Expected, c.Seq)
+			os.Exit(1)
+		}
+		if c.Event == "exec_command_begin" {
+			wantDenied := strings.Contains(c.CommandLine, denyMarker)
+			if c.Denied != wantDenied {
+				fmt.Fprintf(os.Stderr, "hook record %s denied=%v, want %v (command=%q)\n", c.Path, c.Denied, wantDenied, c.CommandLine)
+				os.Exit(1)
+			}
+		}
 		got = append(got, c.Event)
 	}
 	if !equalStrings(got, want) {
@@ -489,9 +1451,96 @@ turn_complete = [[%q, "turn_complete"]]
 		os.Exit(1)
 	}
 
+	if err := assertSpanTree(otlpRecv, want); err != nil {
+		fmt.Fprintf(os.Stderr, "span tree assertion failed: %v\n", err)
+		os.Exit(1)
+	}
+
 	fmt.Println("OK")
 }
 
+// assertSpanTree waits for the OTLP receiver to accumulate the span tree this turn should
+// have exported, then checks: exactly one root "turn" span carrying submission_id, model, and
+// usage attributes; one "exec_command" span and two "function_call" spans parented to it; one
+// "hook" span per successfully-dispatched hook event in wantHookEvents, also parented to it; and
+// a "hook" span for the timed-out exec_command_end invocation carrying a non-OK Status, proving
+// the one hook invocation that actually fails in this test is traced as a failure rather than
+// silently dropped from the tree.
+func assertSpanTree(recv *otlpReceiver, wantHookEvents []string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	var spans []otlpSpan
+	for {
+		spans = recv.Spans()
+		if len(spans) > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+
+	var turn *otlpSpan
+	for i := range spans {
+		if spans[i].Name == "turn" {
+			turn = &spans[i]
+			break
+		}
+	}
+	if turn == nil {
+		return fmt.Errorf("no root \"turn\" span reported (%d spans total)", len(spans))
+	}
+	attrs := turn.attrs()
+	for _, key := range []string{"submission_id", "model", "input_tokens", "output_tokens", "total_tokens"} {
+		if _, ok := attrs[key]; !ok {
+			return fmt.Errorf("turn span missing attribute %q", key)
+		}
+	}
+
+	var execCommandCount, functionCallCount int
+	hookEventsSeen := make(map[string]bool)
+	var timedOutHookSpan *otlpSpan
+	for i := range spans {
+		s := spans[i]
+		if s.ParentSpanID != turn.SpanID {
+			continue
+		}
+		switch s.Name {
+		case "exec_command":
+			execCommandCount++
+			if s.attrs()["exit_status"] == "" {
+				return fmt.Errorf("exec_command span missing exit_status attribute")
+			}
+		case "function_call":
+			functionCallCount++
+		case "hook":
+			event := s.attrs()["event"]
+			hookEventsSeen[event] = true
+			// exec_command_end has two entries (the hung one and the fast
+			// execCommandEndFastLabel one), so pick the span that's actually non-OK rather
+			// than whichever happens to be last.
+			if event == slowHookEvent && s.Status != nil && s.Status.Code != otlpStatusCodeOK {
+				timedOutHookSpan = &spans[i]
+			}
+		}
+	}
+	if execCommandCount < 1 {
+		return fmt.Errorf("expected at least one exec_command span under turn, got %d", execCommandCount)
+	}
+	if functionCallCount < 1 {
+		return fmt.Errorf("expected at least one function_call span under turn, got %d", functionCallCount)
+	}
+	for _, ev := range wantHookEvents {
+		if !hookEventsSeen[ev] {
+			return fmt.Errorf("expected a hook span for event %q under turn", ev)
+		}
+	}
+	if timedOutHookSpan == nil {
+		return fmt.Errorf("expected a hook span for the timed-out %s invocation under turn", slowHookEvent)
+	}
+	if timedOutHookSpan.Status == nil || timedOutHookSpan.Status.Code == otlpStatusCodeOK {
+		return fmt.Errorf("expected the hook span for the timed-out %s invocation to carry a non-OK (error/cancelled) Status, got %#v", slowHookEvent, timedOutHookSpan.Status)
+	}
+	return nil
+}
+
 func equalStrings(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -0,0 +1,271 @@
+// Package responsesstub provides a reusable record/replay double for the
+// OpenAI /v1/responses API, for use by hooks and exec end-to-end tests such
+// as scripts/e2e_hooks_cli.go.
+//
+// In replay mode a Stub serves SSE exchanges from an in-memory or on-disk
+// cassette, matched against the incoming request by Fingerprint (model plus
+// a hash of the normalized input) rather than strict queue order: when no
+// entry's fingerprint matches, the next unconsumed order-fallback entry (one
+// recorded or constructed without a fingerprint) is served instead, so
+// existing turn-by-turn fixtures keep working unchanged.
+//
+// In record mode a Stub proxies requests to a live Responses API endpoint,
+// captures the SSE frames it returns, and appends them to a cassette that
+// can be saved to disk and replayed later without a network connection.
+package responsesstub
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// CassetteVersion is bumped whenever the on-disk entry format changes.
+const CassetteVersion = 1
+
+// Entry is one recorded request/response exchange. Fingerprint is empty for
+// order-fallback entries, which are served in recording order to whichever
+// request doesn't match a fingerprinted entry first.
+type Entry struct {
+	Fingerprint string `json:"fingerprint,omitempty"`
+	SSE         string `json:"sse"`
+}
+
+// Fingerprint derives a stable key for a /v1/responses request body from its
+// model and a hash of its normalized input, so a cassette entry can be
+// matched irrespective of the order requests happen to arrive in.
+func Fingerprint(model string, input any) string {
+	normalized, err := json.Marshal(input)
+	if err != nil {
+		normalized = []byte("null")
+	}
+	sum := sha256.Sum256(normalized)
+	return fmt.Sprintf("%s:%s", model, hex.EncodeToString(sum[:])[:16])
+}
+
+// LoadCassette reads a JSONL cassette file written by SaveCassette. The first
+// line is a {"version": N} header; LoadCassette rejects files whose version
+// doesn't match CassetteVersion.
+func LoadCassette(path string) ([]Entry, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		return nil, fmt.Errorf("responsesstub: empty cassette %s", path)
+	}
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		return nil, fmt.Errorf("responsesstub: parse cassette header: %w", err)
+	}
+	if header.Version != CassetteVersion {
+		return nil, fmt.Errorf("responsesstub: cassette %s has version %d, want %d", path, header.Version, CassetteVersion)
+	}
+	entries := make([]Entry, 0, len(lines)-1)
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("responsesstub: parse cassette entry: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// SaveCassette writes entries to path as a versioned JSONL cassette.
+func SaveCassette(path string, entries []Entry) error {
+	var b strings.Builder
+	header, _ := json.Marshal(struct {
+		Version int `json:"version"`
+	}{CassetteVersion})
+	b.Write(header)
+	b.WriteByte('\n')
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+// Stub is an http.Handler standing in for the Responses API, in either
+// replay or record mode.
+type Stub struct {
+	mu sync.Mutex
+
+	// Replay state.
+	fingerprinted map[string][]string // fingerprint -> remaining SSE bodies
+	fallback      []string            // SSE bodies for entries with no fingerprint
+
+	// Record state.
+	upstreamBaseURL string
+	upstreamAPIKey  string
+	recorded        []Entry
+
+	// Requests bodies seen, for assertions (mirrors the old ad-hoc stubServer).
+	responseReqs []map[string]any
+}
+
+// NewReplay builds a Stub that serves entries from memory or a loaded
+// cassette, matching each request by Fingerprint first and falling back to
+// recording order for requests that match no fingerprint.
+func NewReplay(entries []Entry) *Stub {
+	s := &Stub{
+		fingerprinted: make(map[string][]string),
+	}
+	for _, e := range entries {
+		if e.Fingerprint == "" {
+			s.fallback = append(s.fallback, e.SSE)
+			continue
+		}
+		s.fingerprinted[e.Fingerprint] = append(s.fingerprinted[e.Fingerprint], e.SSE)
+	}
+	return s
+}
+
+// NewRecord builds a Stub that proxies requests to a live Responses API
+// endpoint and accumulates an Entry per exchange for later SaveCassette.
+func NewRecord(upstreamBaseURL, upstreamAPIKey string) *Stub {
+	return &Stub{
+		upstreamBaseURL: strings.TrimRight(upstreamBaseURL, "/"),
+		upstreamAPIKey:  upstreamAPIKey,
+	}
+}
+
+// Recorded returns the entries captured so far in record mode.
+func (s *Stub) Recorded() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Entry, len(s.recorded))
+	copy(out, s.recorded)
+	return out
+}
+
+// RequestBodies returns every parsed /v1/responses request body seen so far,
+// in arrival order, for test assertions.
+func (s *Stub) RequestBodies() []map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]map[string]any, len(s.responseReqs))
+	copy(out, s.responseReqs)
+	return out
+}
+
+func (s *Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/models"):
+		w.Header().Set("content-type", "application/json")
+		_, _ = io.WriteString(w, `{"models":[]}`)
+		return
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/responses"):
+		s.handleResponses(w, r)
+		return
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/responses/compact"):
+		w.Header().Set("content-type", "application/json")
+		_, _ = io.WriteString(w, `{"summary":"ok"}`)
+		return
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Stub) handleResponses(w http.ResponseWriter, r *http.Request) {
+	raw, _ := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+
+	var parsed map[string]any
+	_ = json.Unmarshal(raw, &parsed)
+	if len(parsed) != 0 {
+		s.mu.Lock()
+		s.responseReqs = append(s.responseReqs, parsed)
+		s.mu.Unlock()
+	}
+
+	if s.upstreamBaseURL != "" {
+		s.proxyAndRecord(w, r, raw, parsed)
+		return
+	}
+
+	body, ok := s.popReplay(parsed)
+	if !ok {
+		http.Error(w, "responsesstub: no cassette entry matches this request", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "text/event-stream")
+	_, _ = io.WriteString(w, body)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *Stub) popReplay(parsed map[string]any) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	model, _ := parsed["model"].(string)
+	fp := Fingerprint(model, parsed["input"])
+	if queue := s.fingerprinted[fp]; len(queue) > 0 {
+		s.fingerprinted[fp] = queue[1:]
+		return queue[0], true
+	}
+	if len(s.fallback) > 0 {
+		body := s.fallback[0]
+		s.fallback = s.fallback[1:]
+		return body, true
+	}
+	return "", false
+}
+
+func (s *Stub) proxyAndRecord(w http.ResponseWriter, r *http.Request, raw []byte, parsed map[string]any) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, s.upstreamBaseURL+"/responses", bytes.NewReader(raw))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("responsesstub: build upstream request: %v", err), http.StatusBadGateway)
+		return
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("authorization", "Bearer "+s.upstreamAPIKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("responsesstub: upstream request failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	sseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("responsesstub: read upstream response: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	model, _ := parsed["model"].(string)
+	entry := Entry{
+		Fingerprint: Fingerprint(model, parsed["input"]),
+		SSE:         string(sseBody),
+	}
+	s.mu.Lock()
+	s.recorded = append(s.recorded, entry)
+	s.mu.Unlock()
+
+	w.Header().Set("content-type", "text/event-stream")
+	_, _ = w.Write(sseBody)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}